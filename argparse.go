@@ -5,16 +5,24 @@
 package argparse
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strconv"
 	"strings"
+	"text/template"
+	"time"
 	"unicode"
 )
 
 var nilValue reflect.Value
-var exitFunc func(int) = os.Exit
+var durationType = reflect.TypeOf(time.Duration(0))
 
 const (
 	Optional   = -1
@@ -91,6 +99,32 @@ type ArgumentParser struct {
 	PositionalArguments []*PositionalArgument
 	// OptionalArguments is an array of possible argument from the command line
 	OptionalArguments []*OptionalArgument
+	// Name is the name this parser was registered under with Command().
+	// It is empty for the top-level parser returned by New().
+	Name string
+	// Parent is the parser this one was created from via Command(),
+	// or nil for the top-level parser.
+	Parent *ArgumentParser
+	// Commands is an array of the subcommands added with Command(), in
+	// the order they were declared.
+	Commands []*ArgumentParser
+	// Action, if set, is called once this parser has finished parsing
+	// successfully. When one of its Commands is selected, only the
+	// innermost selected command's Action is called, not this one.
+	Action func() error
+	// HelpTemplate is the text/template used by Help() to render the
+	// Commands, Positional arguments and Options sections which follow
+	// Usage(). See the package-level templateFuncs for the functions
+	// available to it (wrap, pad, optNames, argsString, ...).
+	HelpTemplate string
+	// UsageTemplate is the text/template used by Usage() to render the
+	// "usage: ..." line and description.
+	UsageTemplate string
+
+	selectedCommand *ArgumentParser
+	config          map[string]string
+	output          io.Writer
+	exitFunc        func(int)
 }
 
 // Allocates a new ArgumentParser object.
@@ -102,115 +136,668 @@ func New(description string) (p *ArgumentParser) {
 		WordWrapWidth:       80,
 		PositionalArguments: make([]*PositionalArgument, 0),
 		OptionalArguments:   make([]*OptionalArgument, 0),
+		HelpTemplate:        defaultHelpTemplate,
+		UsageTemplate:       defaultUsageTemplate,
 	}
 
 	helpCallback := func(nArgs int, args []string, dest reflect.Value) (err error) {
 		p.Help()
-		exitFunc(0)
+		p.exitFn()(0)
 		return nil
 	}
 
 	p.Option('h', "help", "", 0, helpCallback, "", "Shows this help message before exiting.")
 
+	completeCallback := func(nArgs int, args []string, dest reflect.Value) (err error) {
+		p.runCompletion()
+		p.exitFn()(0)
+		return nil
+	}
+
+	p.Option(0, "complete", "", 0, completeCallback, "", "")
+	p.OptionalArguments[len(p.OptionalArguments)-1].Hidden = true
+
+	for _, shell := range completionShells {
+		shell := shell
+
+		scriptCallback := func(nArgs int, args []string, dest reflect.Value) (err error) {
+			p.Completion(shell, p.outputWriter())
+			p.exitFn()(0)
+			return nil
+		}
+
+		p.Option(0, "completion-script-"+shell, "", 0, scriptCallback, "", "")
+		p.OptionalArguments[len(p.OptionalArguments)-1].Hidden = true
+	}
+
+	return p
+}
+
+// SetOutput directs Help(), Usage(), Error() and the default shell
+// completion script action (--completion-script-<shell>) to w instead
+// of os.Stdout. It also affects any subcommand which doesn't have its
+// own output set, whether SetOutput is called before or after the
+// subcommand was added with Command() - output is resolved by walking
+// up Parent at the time it's needed, not copied down at Command() time.
+func (p *ArgumentParser) SetOutput(w io.Writer) {
+	p.output = w
+}
+
+// outputWriter returns the writer in effect for p: the value set via
+// SetOutput, inherited from the nearest ancestor which has one, or
+// os.Stdout if none was ever set anywhere in the chain.
+func (p *ArgumentParser) outputWriter() io.Writer {
+	if p.output != nil {
+		return p.output
+	}
+
+	if p.Parent != nil {
+		return p.Parent.outputWriter()
+	}
+
+	return os.Stdout
+}
+
+// SetExitFunc overrides the function called once ParseArgs has finished
+// handling -h/--help or a parse error, instead of the default os.Exit.
+// It is mainly useful in tests, to recover from a panic instead of
+// actually exiting the process. Like SetOutput, it also affects any
+// subcommand which doesn't have its own exit function set, regardless
+// of whether SetExitFunc is called before or after the subcommand was
+// added with Command().
+func (p *ArgumentParser) SetExitFunc(f func(int)) {
+	p.exitFunc = f
+}
+
+// exitFn returns the exit function in effect for p: the value set via
+// SetExitFunc, inherited from the nearest ancestor which has one, or
+// os.Exit if none was ever set anywhere in the chain.
+func (p *ArgumentParser) exitFn() func(int) {
+	if p.exitFunc != nil {
+		return p.exitFunc
+	}
+
+	if p.Parent != nil {
+		return p.Parent.exitFn()
+	}
+
+	return os.Exit
+}
+
+// NewFromStruct allocates a new ArgumentParser the same way New() does,
+// then inspects the fields of v (which must be a pointer to a struct)
+// and registers one Option or Argument per tagged field, so that callers
+// don't have to make paired Option()/Argument() calls by hand. It
+// recognises the following struct tags:
+//
+//	short:"b"           single-letter option name
+//	long:"by"           multi-letter option name
+//	positional:"true"   register as a PositionalArgument instead of an option
+//	nargs:"?"|"*"|"+"|N consumed command line words (default: 1, or "+" for a slice)
+//	default:"..."       value used when nothing else sets the field
+//	choices:"a,b,c"     restrict the value(s) to this set
+//	required:"true"     fail at end-of-parse if the field is still zero
+//	metavar:"..."       name shown for the argument in the help message
+//	help:"..."          help text shown in the help message
+//	env:"VAR_NAME"      environment variable consulted as a fallback
+//
+// For an option, default is applied at the end of ParseArgs if the
+// command line, env and config file all left the field zero; for a
+// positional field it is stored into v right away by NewFromStruct.
+// The env and required tags apply to options only and are ignored on
+// positional fields.
+//
+// Store is used for scalar fields and Append for slice fields, unless
+// the field is a bool with no explicit nargs tag, in which case it is
+// treated as a zero-argument switch via StoreConst(true). Anonymous
+// (embedded) struct fields are walked recursively, so an embedded
+// struct can be used to group related options without changing how
+// they are addressed on the command line. A named struct field is not
+// walked; it is registered like any other field.
+//
+// The programmatic Option()/Argument() API can still be used on the
+// returned parser to register further arguments by hand.
+func NewFromStruct(description string, v interface{}) (p *ArgumentParser) {
+	p = New(description)
+
+	dest := reflect.ValueOf(v)
+	if dest.Kind() == reflect.Ptr {
+		dest = dest.Elem()
+	}
+
+	p.addStructFields(dest)
 	return p
 }
 
+func (p *ArgumentParser) addStructFields(dest reflect.Value) {
+	t := dest.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		value := dest.Field(i)
+
+		if field.PkgPath != "" {
+			continue // unexported
+		}
+
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			p.addStructFields(value)
+			continue
+		}
+
+		p.addStructField(field, value)
+	}
+}
+
+func (p *ArgumentParser) addStructField(field reflect.StructField, value reflect.Value) {
+	help := field.Tag.Get("help")
+	metavar := field.Tag.Get("metavar")
+	if metavar == "" {
+		metavar = strings.ToUpper(field.Name)
+	}
+
+	var nArgs int
+	var action ActionFunc
+
+	switch {
+	case field.Tag.Get("nargs") != "":
+		nArgs = parseNArgs(field.Tag.Get("nargs"))
+		action = actionForKind(value)
+	case value.Kind() == reflect.Bool:
+		nArgs = 0
+		action = StoreConst(true)
+	case value.Kind() == reflect.Slice:
+		nArgs = OneOrMore
+		action = Append
+	default:
+		nArgs = 1
+		action = Store
+	}
+
+	var choicesList []string
+	if choices := field.Tag.Get("choices"); choices != "" {
+		choicesList = strings.Split(choices, ",")
+		action = Choice(action, choicesList...)
+	}
+
+	defaultVal, hasDefault := field.Tag.Lookup("default")
+
+	if field.Tag.Get("positional") == "true" {
+		// Positional arguments aren't subject to the env/config
+		// fallback, so their default can be applied immediately.
+		if hasDefault {
+			storeValue(defaultVal, value)
+		}
+
+		p.Argument(field.Name, nArgs, action, metavar, help)
+		p.PositionalArguments[len(p.PositionalArguments)-1].Choices = choicesList
+		return
+	}
+
+	shortName := byte(0)
+	if s := field.Tag.Get("short"); s != "" {
+		shortName = s[0]
+	}
+
+	longName := field.Tag.Get("long")
+	if longName == "" && shortName == 0 {
+		longName = strings.ToLower(field.Name)
+	}
+
+	p.Option(shortName, longName, field.Name, nArgs, action, metavar, help)
+
+	optArg := p.OptionalArguments[len(p.OptionalArguments)-1]
+	optArg.Choices = choicesList
+
+	if hasDefault {
+		optArg.Default = defaultVal
+	}
+
+	if env, ok := field.Tag.Lookup("env"); ok {
+		optArg.EnvVar = env
+	}
+
+	if field.Tag.Get("required") == "true" {
+		optArg.Required = true
+	}
+}
+
+func parseNArgs(tag string) int {
+	switch tag {
+	case "?":
+		return Optional
+	case "*":
+		return ZeroOrMore
+	case "+":
+		return OneOrMore
+	default:
+		n, err := strconv.Atoi(tag)
+		if err != nil {
+			return 1
+		}
+
+		return n
+	}
+}
+
+func actionForKind(value reflect.Value) ActionFunc {
+	if value.Kind() == reflect.Slice {
+		return Append
+	}
+
+	return Store
+}
+
+// ConfigFile loads a set of option values from path, to be used by
+// ParseArgs as a fallback for any option whose destination field is
+// still zero once the command line and environment have been
+// consulted. format must be "ini" or "json"; in both cases the file is
+// read as a flat set of key/value pairs (INI section headers are
+// accepted but ignored) and keys are matched against an option's
+// LongName.
+func (p *ArgumentParser) ConfigFile(path string, format string) (err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case "json":
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber() // keep numbers as the literal token, not a lossy float64
+
+		values := map[string]interface{}{}
+		if err = decoder.Decode(&values); err != nil {
+			return err
+		}
+
+		p.config = make(map[string]string, len(values))
+		for k, v := range values {
+			if n, ok := v.(json.Number); ok {
+				p.config[k] = n.String()
+			} else {
+				p.config[k] = fmt.Sprintf("%v", v)
+			}
+		}
+
+	case "ini":
+		p.config = parseINIConfig(data)
+
+	default:
+		return fmt.Errorf("Unknown config file format: %s", format)
+	}
+
+	return nil
+}
+
+func parseINIConfig(data []byte) (config map[string]string) {
+	config = map[string]string{}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+
+		if line == "" || line[0] == ';' || line[0] == '#' || line[0] == '[' {
+			continue
+		}
+
+		pos := strings.Index(line, "=")
+		if pos < 0 {
+			continue
+		}
+
+		key := strings.TrimSpace(line[:pos])
+		value := strings.TrimSpace(line[pos+1:])
+		config[key] = value
+	}
+
+	return config
+}
+
 // The Error method output the usage message, the error string parameter
 // and Exit the process
 func (p *ArgumentParser) Error(s string) {
 	p.Usage()
-	fmt.Printf("\nTry %s --help for help\n\n*** %s\n", os.Args[0], s)
-	exitFunc(2)
+	fmt.Fprintf(p.outputWriter(), "\nTry %s --help for help\n\n*** %s\n", p.ProgName(), s)
+	p.exitFn()(2)
 }
 
 // The Usage() method output a short description of the program
-// command line based on the added optional and positional arguments
+// command line based on the added optional and positional arguments.
+// It is rendered from p.UsageTemplate.
 func (p *ArgumentParser) Usage() {
-	optionsStr := ""
-	if len(p.OptionalArguments) >= 0 {
-		optionsStr = " (options)"
-	}
+	t := template.Must(template.New("usage").Funcs(templateFuncs).Parse(p.UsageTemplate))
+	t.Execute(p.outputWriter(), p)
+}
 
-	argsStr := ""
-	for _, posArg := range p.PositionalArguments {
-		argsStr += " " + argsString(posArg.NArgs, posArg.Metavar)
+// ProgName returns the name under which this parser should be addressed
+// on the command line, e.g. "prog sub subsub" for a nested subcommand.
+func (p *ArgumentParser) ProgName() string {
+	if p.Parent == nil {
+		return os.Args[0]
 	}
 
-	fmt.Printf("usage: %s%s%s\n", os.Args[0], optionsStr, argsStr)
-
-	if p.Description != "" {
-		fmt.Printf("\n%s - %s", os.Args[0], wordWrap(p.Description, p.WordWrapWidth, len(os.Args[0])+3))
-	}
+	return p.Parent.ProgName() + " " + p.Name
 }
 
 // The Help() method display a long description of the program
-// command line based on the added optional and positional arguments
+// command line based on the added optional and positional arguments.
+// It first calls Usage(), then renders p.HelpTemplate for the
+// Commands, Positional arguments and Options sections.
 func (p *ArgumentParser) Help() {
 	p.Usage()
 
-	if len(p.PositionalArguments) > 0 {
-		fmt.Printf("\nPositional arguments:\n")
+	t := template.Must(template.New("help").Funcs(templateFuncs).Parse(p.HelpTemplate))
+	t.Execute(p.outputWriter(), p)
+}
+
+// VisibleOptionalArguments returns the subset of OptionalArguments which
+// are not Hidden, i.e. the ones Help() lists under "Options:".
+func (p *ArgumentParser) VisibleOptionalArguments() []*OptionalArgument {
+	visible := []*OptionalArgument{}
+	for _, optArg := range p.OptionalArguments {
+		if !optArg.Hidden {
+			visible = append(visible, optArg)
+		}
+	}
 
-		posArgStrs := []string{}
-		l := 0
+	return visible
+}
 
-		for _, posArg := range p.PositionalArguments {
-			s := fmt.Sprintf("  %s  ", argsString(posArg.NArgs, posArg.Metavar))
-			posArgStrs = append(posArgStrs, s)
+// optArgAnnotations builds the "(default: ...) (env: ...) (required)"
+// suffix appended to an option's help text.
+func optArgAnnotations(optArg *OptionalArgument) (s string) {
+	if optArg.Default != "" {
+		s += fmt.Sprintf(" (default: %s)", optArg.Default)
+	}
 
-			if len(s) > l {
-				l = len(s)
-			}
+	if optArg.EnvVar != "" {
+		s += fmt.Sprintf(" (env: %s)", optArg.EnvVar)
+	}
+
+	if optArg.Required {
+		s += " (required)"
+	}
+
+	return s
+}
+
+// optNames formats an option's short/long names and metavar the way
+// Help() lists them, e.g. "-f, --force" or "-o FILE, --output=FILE".
+func optNames(optArg *OptionalArgument) string {
+	ol := []string{}
+
+	if optArg.ShortName != 0 {
+		if optArg.Metavar == "" {
+			ol = append(ol, fmt.Sprintf("-%c", optArg.ShortName))
+		} else {
+			ol = append(ol, fmt.Sprintf("-%c %s", optArg.ShortName, optArg.Metavar))
 		}
+	}
 
-		for i, posArg := range p.PositionalArguments {
-			s := posArgStrs[i]
-			fmt.Print(s)
-			fmt.Print(strings.Repeat(" ", l-len(s)))
-			fmt.Print(wordWrap(posArg.Help, p.WordWrapWidth, l+1))
+	if optArg.LongName != "" {
+		if optArg.Metavar == "" {
+			ol = append(ol, fmt.Sprintf("--%s", optArg.LongName))
+		} else {
+			ol = append(ol, fmt.Sprintf("--%s=%s", optArg.LongName, optArg.Metavar))
 		}
 	}
 
-	if len(p.OptionalArguments) > 0 {
-		fmt.Printf("\nOptions:\n")
+	return strings.Join(ol, ", ")
+}
 
-		optArgStrs := []string{}
-		l := 0
+// optHelpText returns an option's help text with its annotations (see
+// optArgAnnotations) appended, ready to be wrapped.
+func optHelpText(optArg *OptionalArgument) string {
+	return optArg.Help + optArgAnnotations(optArg)
+}
 
-		for _, optArg := range p.OptionalArguments {
-			ol := []string{}
+// cmdLabel, posLabel and optLabel build the left-hand column entry
+// Help() prints for a subcommand, positional argument or option,
+// before it has been padded to the column's width by pad().
+func cmdLabel(cmd *ArgumentParser) string {
+	return fmt.Sprintf("  %s  ", cmd.Name)
+}
 
-			if optArg.ShortName != 0 {
-				if optArg.Metavar == "" {
-					ol = append(ol, fmt.Sprintf("-%c", optArg.ShortName))
-				} else {
-					ol = append(ol, fmt.Sprintf("-%c %s", optArg.ShortName, optArg.Metavar))
-				}
+func posLabel(posArg *PositionalArgument) string {
+	return fmt.Sprintf("  %s  ", argsString(posArg.NArgs, posArg.Metavar))
+}
+
+func optLabel(optArg *OptionalArgument) string {
+	return "  " + optNames(optArg) + " "
+}
+
+// cmdColumnWidth, posColumnWidth and optColumnWidth return the width
+// Help() aligns a section's left-hand column to: the length of its
+// longest label.
+func cmdColumnWidth(cmds []*ArgumentParser) (width int) {
+	for _, cmd := range cmds {
+		if l := len(cmdLabel(cmd)); l > width {
+			width = l
+		}
+	}
+
+	return width
+}
+
+func posColumnWidth(posArgs []*PositionalArgument) (width int) {
+	for _, posArg := range posArgs {
+		if l := len(posLabel(posArg)); l > width {
+			width = l
+		}
+	}
+
+	return width
+}
+
+func optColumnWidth(optArgs []*OptionalArgument) (width int) {
+	for _, optArg := range optArgs {
+		if l := len(optLabel(optArg)); l > width {
+			width = l
+		}
+	}
+
+	return width
+}
+
+// pad right-pads s with spaces up to width, the way Help() aligns its
+// two columns.
+func pad(s string, width int) string {
+	if len(s) < width {
+		return s + strings.Repeat(" ", width-len(s))
+	}
+
+	return s
+}
+
+// templateFuncs are the functions available to HelpTemplate and
+// UsageTemplate.
+var templateFuncs = template.FuncMap{
+	"wrap":           wordWrap,
+	"pad":            pad,
+	"optNames":       optNames,
+	"argsString":     argsString,
+	"optHelpText":    optHelpText,
+	"cmdLabel":       cmdLabel,
+	"posLabel":       posLabel,
+	"optLabel":       optLabel,
+	"cmdColumnWidth": cmdColumnWidth,
+	"posColumnWidth": posColumnWidth,
+	"optColumnWidth": optColumnWidth,
+	"add":            func(a, b int) int { return a + b },
+}
+
+// defaultUsageTemplate reproduces the "usage: ..." line and description
+// Usage() has always printed.
+const defaultUsageTemplate = "usage: {{.ProgName}} (options){{if .Commands}} <command>{{end}}" +
+	"{{range .PositionalArguments}} {{argsString .NArgs .Metavar}}{{end}}\n" +
+	"{{if .Description}}\n{{.ProgName}} - {{wrap .Description .WordWrapWidth (add (len .ProgName) 3)}}{{end}}"
+
+// defaultHelpTemplate reproduces the Commands/Positional arguments/Options
+// sections Help() has always printed after Usage().
+const defaultHelpTemplate = "" +
+	"{{if .Commands}}\nCommands:\n" +
+	"{{$w := cmdColumnWidth .Commands}}{{range .Commands}}{{pad (cmdLabel .) $w}}{{wrap .Description $.WordWrapWidth (add $w 1)}}{{end}}{{end}}" +
+	"{{if .PositionalArguments}}\nPositional arguments:\n" +
+	"{{$w := posColumnWidth .PositionalArguments}}{{range .PositionalArguments}}{{pad (posLabel .) $w}}{{wrap .Help $.WordWrapWidth (add $w 1)}}{{end}}{{end}}" +
+	"{{if .VisibleOptionalArguments}}\nOptions:\n" +
+	"{{$w := optColumnWidth .VisibleOptionalArguments}}{{range .VisibleOptionalArguments}}{{pad (optLabel .) $w}}{{wrap (optHelpText .) $.WordWrapWidth (add $w 1)}}{{end}}{{end}}"
+
+// completionShells lists the shells Completion() knows how to generate
+// a script for, and the names used to build the hidden
+// --completion-script-<shell> flags installed by New().
+var completionShells = []string{"bash", "zsh", "fish"}
+
+// Completion writes a shell completion script for shell ("bash", "zsh"
+// or "fish") to w. The script invokes the program with a hidden
+// --complete flag, reading the COMP_LINE/COMP_POINT the shell exposes
+// during completion, and prints one candidate per line.
+func (p *ArgumentParser) Completion(shell string, w io.Writer) (err error) {
+	prog := filepath.Base(os.Args[0])
+
+	switch shell {
+	case "bash":
+		_, err = fmt.Fprintf(w, bashCompletionTemplate, prog, prog, prog, prog)
+
+	case "zsh":
+		_, err = fmt.Fprintf(w, zshCompletionTemplate, prog, prog, prog, prog, prog)
+
+	case "fish":
+		_, err = fmt.Fprintf(w, fishCompletionTemplate, prog, prog, prog, prog)
+
+	default:
+		return fmt.Errorf("Unknown shell for completion: %s", shell)
+	}
+
+	return err
+}
+
+const bashCompletionTemplate = `_%s_autocomplete() {
+    local cur opts
+    cur="${COMP_WORDS[COMP_CWORD]}"
+    opts=$(COMP_LINE="${COMP_LINE}" COMP_POINT="${COMP_POINT}" %s --complete)
+    COMPREPLY=( $(compgen -W "${opts}" -- "${cur}") )
+    return 0
+}
+complete -F _%s_autocomplete %s
+`
+
+const zshCompletionTemplate = `#compdef %s
+_%s() {
+    local -a opts
+    opts=("${(@f)$(COMP_LINE="${BUFFER}" COMP_POINT="${CURSOR}" %s --complete)}")
+    _describe 'values' opts
+}
+compdef _%s %s
+`
+
+const fishCompletionTemplate = `function __%s_complete
+    set -lx COMP_LINE (commandline -cp)
+    set -lx COMP_POINT (string length (commandline -cp))
+    %s --complete
+end
+complete -c %s -f -a '(__%s_complete)'
+`
+
+// runCompletion is the implementation of the hidden --complete flag: it
+// reads COMP_LINE/COMP_POINT from the environment and prints one
+// candidate completion per line to the parser's output (see SetOutput),
+// os.Stdout by default.
+func (p *ArgumentParser) runCompletion() {
+	line := os.Getenv("COMP_LINE")
+
+	point, err := strconv.Atoi(os.Getenv("COMP_POINT"))
+	if err != nil || point < 0 || point > len(line) {
+		point = len(line)
+	}
+
+	words := strings.Fields(line[:point])
+	prefix := ""
+
+	if len(words) > 0 && !strings.HasSuffix(line[:point], " ") {
+		prefix = words[len(words)-1]
+		words = words[:len(words)-1]
+	}
+
+	args := []string{}
+	if len(words) > 1 {
+		args = words[1:]
+	}
+
+	for _, candidate := range p.complete(args, prefix) {
+		fmt.Fprintln(p.outputWriter(), candidate)
+	}
+}
+
+// complete walks into the subcommand selected by args, if any, then
+// returns the candidate completions for prefix in that context: long
+// and short option names, subcommand names, and whatever Choices or
+// Completer the matching PositionalArguments/OptionalArguments offer.
+func (p *ArgumentParser) complete(args []string, prefix string) (candidates []string) {
+	for i, a := range args {
+		if cmd := p.findCommand(a); cmd != nil {
+			return cmd.complete(args[i+1:], prefix)
+		}
+	}
+
+	if strings.HasPrefix(prefix, "--") {
+		for _, optArg := range p.OptionalArguments {
+			if optArg.Hidden || optArg.LongName == "" {
+				continue
 			}
 
-			if optArg.LongName != "" {
-				if optArg.Metavar == "" {
-					ol = append(ol, fmt.Sprintf("--%s", optArg.LongName))
-				} else {
-					ol = append(ol, fmt.Sprintf("--%s=%s", optArg.LongName, optArg.Metavar))
-				}
+			name := "--" + optArg.LongName
+			if strings.HasPrefix(name, prefix) {
+				candidates = append(candidates, name)
 			}
+		}
+
+		return candidates
+	}
 
-			s := "  " + strings.Join(ol, ", ") + " "
-			optArgStrs = append(optArgStrs, s)
+	if strings.HasPrefix(prefix, "-") {
+		for _, optArg := range p.OptionalArguments {
+			if optArg.Hidden || optArg.ShortName == 0 {
+				continue
+			}
 
-			if len(s) > l {
-				l = len(s)
+			name := "-" + string(optArg.ShortName)
+			if strings.HasPrefix(name, prefix) {
+				candidates = append(candidates, name)
 			}
 		}
 
-		for i, optArg := range p.OptionalArguments {
-			s := optArgStrs[i]
-			fmt.Print(s)
-			fmt.Print(strings.Repeat(" ", l-len(s)))
-			fmt.Print(wordWrap(optArg.Help, p.WordWrapWidth, l+1))
+		return candidates
+	}
+
+	for _, cmd := range p.Commands {
+		if strings.HasPrefix(cmd.Name, prefix) {
+			candidates = append(candidates, cmd.Name)
 		}
 	}
+
+	for _, posArg := range p.PositionalArguments {
+		candidates = append(candidates, completionsFor(posArg.Choices, posArg.Completer, prefix)...)
+	}
+
+	for _, optArg := range p.OptionalArguments {
+		candidates = append(candidates, completionsFor(optArg.Choices, optArg.Completer, prefix)...)
+	}
+
+	return candidates
+}
+
+func completionsFor(choices []string, completer func(string) []string, prefix string) (candidates []string) {
+	for _, choice := range choices {
+		if strings.HasPrefix(choice, prefix) {
+			candidates = append(candidates, choice)
+		}
+	}
+
+	if completer != nil {
+		candidates = append(candidates, completer(prefix)...)
+	}
+
+	return candidates
 }
 
 // Argument() add a new positional argument to the parser.
@@ -253,6 +840,51 @@ func (p *ArgumentParser) Option(shortName byte, longName string, dest string, nA
 	})
 }
 
+// Command() adds a subcommand to the parser and returns the ArgumentParser
+// used to describe it. The returned parser is used exactly like any other
+// ArgumentParser: register its own PositionalArguments and
+// OptionalArguments, and optionally further Commands of its own to build
+// a nested command tree (e.g. "prog remote add").
+//
+// name is the word which must appear on the command line to select this
+// subcommand. help is a short description shown next to name in the
+// parent's Help() output, and doubles as this subcommand's own
+// Description.
+func (p *ArgumentParser) Command(name string, help string) (cmd *ArgumentParser) {
+	cmd = New(help)
+	cmd.Name = name
+	cmd.Parent = p
+	p.Commands = append(p.Commands, cmd)
+	return cmd
+}
+
+// SelectedCommand() returns the subcommand which was selected on the
+// command line during the last call to ParseArgs, or nil if this parser
+// has no Commands or none of them was selected.
+func (p *ArgumentParser) SelectedCommand() *ArgumentParser {
+	return p.selectedCommand
+}
+
+func (p *ArgumentParser) findCommand(name string) *ArgumentParser {
+	for _, cmd := range p.Commands {
+		if cmd.Name == name {
+			return cmd
+		}
+	}
+
+	return nil
+}
+
+// runAction calls p.Action, if any, once this parser has finished parsing
+// successfully.
+func (p *ArgumentParser) runAction() (err error) {
+	if p.Action != nil {
+		return p.Action()
+	}
+
+	return nil
+}
+
 // Parse() parses the command line and fill the structure given as parameter
 // with the result of the parsing.
 func (p *ArgumentParser) Parse(values interface{}) (err error) {
@@ -299,6 +931,28 @@ func (p *ArgumentParser) ParseArgs(values interface{}, rawArgs []string) (err er
 				err = p.parseShortOptions(argStr[1:], args, dest)
 			}
 
+		} else if len(p.Commands) > 0 {
+			cmd := p.findCommand(argStr)
+			if cmd == nil {
+				p.Error(fmt.Sprintf("No such command: %s", argStr))
+				return CommandLineError("No such command: " + argStr)
+			}
+
+			remaining := []string{}
+			for !args.EOF() {
+				remaining = append(remaining, args.Next())
+			}
+
+			// Env/config fallback, positional arguments and Required
+			// are all about to be skipped for the rest of this parser,
+			// as the remaining words on the command line belong to cmd
+			// instead: settle them for p now, before dispatching.
+			if err = p.finishParse(dest, posArgs); err != nil {
+				return err
+			}
+
+			p.selectedCommand = cmd
+			return cmd.ParseArgs(values, remaining)
 		} else {
 			posArgs = append(posArgs, argStr)
 		}
@@ -312,15 +966,77 @@ func (p *ArgumentParser) ParseArgs(values interface{}, rawArgs []string) (err er
 		}
 	}
 
+	if err = p.finishParse(dest, posArgs); err != nil {
+		return err
+	}
+
+	return p.runAction()
+}
+
+// finishParse applies the env/config/default fallback to any of p's
+// options whose destination field the command line left zero, parses
+// posArgs against p's PositionalArguments, then enforces Required. It
+// is called both at the end of ordinary parsing and, for a parser with
+// Commands, right before dispatching to whichever one was selected -
+// since a selected subcommand consumes the rest of the command line,
+// this is p's only chance to settle its own state.
+func (p *ArgumentParser) finishParse(dest reflect.Value, posArgs []string) (err error) {
+	for _, optArg := range p.OptionalArguments {
+		if optArg.Dest == "" {
+			continue
+		}
+
+		field := dest.FieldByName(optArg.Dest)
+		if !field.IsValid() || !field.IsZero() {
+			continue
+		}
+
+		if optArg.EnvVar != "" {
+			if envVal := os.Getenv(optArg.EnvVar); envVal != "" {
+				if err := optArg.Action(1, []string{envVal}, field); err != nil {
+					return CommandLineError(fmt.Sprintf("Invalid value %q for environment variable %s: %s", envVal, optArg.EnvVar, err))
+				}
+				continue
+			}
+		}
+
+		if configVal, ok := p.config[optArg.LongName]; ok {
+			if err := optArg.Action(1, []string{configVal}, field); err != nil {
+				return CommandLineError(fmt.Sprintf("Invalid value %q for --%s in config file: %s", configVal, optArg.LongName, err))
+			}
+			continue
+		}
+
+		// Applied last, so a struct-tag default doesn't pre-empt the
+		// env/config fallback above by making the field non-zero
+		// before they get a chance to run. Routed through Action, not
+		// storeValue, so Choice/Units wrapping still applies to defaults.
+		if optArg.Default != "" {
+			if err := optArg.Action(1, []string{optArg.Default}, field); err != nil {
+				return CommandLineError(fmt.Sprintf("Invalid default value %q for --%s: %s", optArg.Default, optArg.LongName, err))
+			}
+		}
+	}
+
 	posArgsList := &argsList{posArgs, 0, ""}
 
 	for _, posArg := range p.PositionalArguments {
-		err = posArg.parse(posArgsList, dest)
-		if err != nil {
+		if err = posArg.parse(posArgsList, dest); err != nil {
 			return err
 		}
 	}
 
+	for _, optArg := range p.OptionalArguments {
+		if !optArg.Required || optArg.Dest == "" {
+			continue
+		}
+
+		field := dest.FieldByName(optArg.Dest)
+		if field.IsValid() && field.IsZero() {
+			return CommandLineError(fmt.Sprintf("Option --%s is required", optArg.LongName))
+		}
+	}
+
 	return nil
 }
 
@@ -369,6 +1085,14 @@ type PositionalArgument struct {
 	Action  ActionFunc
 	Metavar string
 	Help    string
+	// Choices, if set, is offered by shell completion in addition to
+	// whatever Completer returns. It is purely informational; use
+	// Choice() on Action to actually enforce it.
+	Choices []string
+	// Completer, if set, is called by shell completion with the prefix
+	// of the word being completed and returns candidate completions,
+	// e.g. matching file paths.
+	Completer func(prefix string) []string
 }
 
 func (arg *PositionalArgument) parse(args *argsList, destStruct reflect.Value) (err error) {
@@ -396,6 +1120,30 @@ type OptionalArgument struct {
 	Action    ActionFunc
 	Metavar   string
 	Help      string
+	// Required, if true, makes ParseArgs fail with a CommandLineError
+	// unless this option's destination field ends up non-zero, whether
+	// from the command line, the environment, or a default value.
+	Required bool
+	// EnvVar, if set, names an environment variable consulted by
+	// ParseArgs when this option's destination field is still zero
+	// after the command line has been processed.
+	EnvVar string
+	// Default, if set, is shown in the help message and is applied to
+	// this option's destination field by ParseArgs if it is still zero
+	// after the command line, EnvVar, and config file have all been
+	// consulted: command line > EnvVar > config file > Default.
+	Default string
+	// Hidden, if true, keeps this option out of Help()'s listing. Used
+	// for the machinery flags New() installs for shell completion.
+	Hidden bool
+	// Choices, if set, is offered by shell completion in addition to
+	// whatever Completer returns. It is purely informational; use
+	// Choice() on Action to actually enforce it.
+	Choices []string
+	// Completer, if set, is called by shell completion with the prefix
+	// of the word being completed and returns candidate completions,
+	// e.g. matching file paths.
+	Completer func(prefix string) []string
 }
 
 func (arg *OptionalArgument) parse(args *argsList, destStruct reflect.Value) (err error) {
@@ -521,6 +1269,99 @@ func Append(nArgs int, args []string, value reflect.Value) (err error) {
 	return nil
 }
 
+// Duration is Store specialized for time.Duration destinations. It is
+// simply an alias for Store, which already recognises time.Duration
+// fields in storeValue and parses them with time.ParseDuration (e.g.
+// "1h30m"); it exists for readability at the call site, e.g.
+// parser.Option(0, "timeout", "Timeout", 1, Duration, "DURATION", "...").
+var Duration ActionFunc = Store
+
+// A UnitTable maps a unit suffix to the multiplier applied to the
+// numeric value it follows, for use with Units(). The empty string key
+// gives the multiplier applied when a value has no recognised suffix.
+type UnitTable map[string]int64
+
+// Bytes is a UnitTable recognising the SI decimal (K, M, G, T, P) and
+// IEC binary (KiB, MiB, GiB, TiB, PiB) byte-count suffixes, e.g. "4GiB"
+// or "500M".
+var Bytes = UnitTable{
+	"":    1,
+	"K":   1000,
+	"M":   1000 * 1000,
+	"G":   1000 * 1000 * 1000,
+	"T":   1000 * 1000 * 1000 * 1000,
+	"P":   1000 * 1000 * 1000 * 1000 * 1000,
+	"KiB": 1024,
+	"MiB": 1024 * 1024,
+	"GiB": 1024 * 1024 * 1024,
+	"TiB": 1024 * 1024 * 1024 * 1024,
+	"PiB": 1024 * 1024 * 1024 * 1024 * 1024,
+}
+
+// SI is a UnitTable recognising the k/K, M, G, T, P decimal multiplier
+// suffixes, e.g. "10k" or "2M".
+var SI = UnitTable{
+	"":  1,
+	"k": 1000,
+	"K": 1000,
+	"M": 1000 * 1000,
+	"G": 1000 * 1000 * 1000,
+	"T": 1000 * 1000 * 1000 * 1000,
+	"P": 1000 * 1000 * 1000 * 1000 * 1000,
+}
+
+// Units returns an ActionFunc which parses each argument as a number
+// followed by an optional unit suffix from table (e.g. "4GiB" with
+// Bytes, or "10k" with SI), multiplies the number by the matching
+// suffix's value, and passes the result on to subAction as a plain
+// base-10 integer string. It rejects values which don't fit in an
+// int64.
+func Units(subAction ActionFunc, table UnitTable) (action ActionFunc) {
+	return func(nArgs int, args []string, value reflect.Value) (err error) {
+		parsed := make([]string, len(args))
+
+		for i, arg := range args {
+			n, err := parseUnits(arg, table)
+			if err != nil {
+				return err
+			}
+
+			parsed[i] = strconv.FormatInt(n, 10)
+		}
+
+		return subAction(nArgs, parsed, value)
+	}
+}
+
+func parseUnits(s string, table UnitTable) (n int64, err error) {
+	suffix := ""
+	for u := range table {
+		if u != "" && strings.HasSuffix(s, u) && len(u) > len(suffix) {
+			suffix = u
+		}
+	}
+
+	multiplier, ok := table[suffix]
+	if !ok {
+		return 0, fmt.Errorf("Unknown unit suffix in %q", s)
+	}
+
+	numPart := strings.TrimSuffix(s, suffix)
+
+	value, err := strconv.ParseFloat(numPart, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	result := value * float64(multiplier)
+	// float64(math.MaxInt64) rounds up to 2^63, which itself doesn't fit.
+	if result >= math.MaxInt64 || result < math.MinInt64 {
+		return 0, fmt.Errorf("Value out of range: %s", s)
+	}
+
+	return int64(result), nil
+}
+
 func readArgStrings(nArgs int, args *argsList) (argStrings []string) {
 	switch nArgs {
 	case Optional:
@@ -585,6 +1426,13 @@ func storeValue(s string, value reflect.Value) (err error) {
 		value.SetInt(n)
 
 	case reflect.Int64:
+		if value.Type() == durationType {
+			var d time.Duration
+			d, err = time.ParseDuration(s)
+			value.SetInt(int64(d))
+			break
+		}
+
 		var n int64
 		n, err = strconv.ParseInt(s, 0, 64)
 		value.SetInt(n)
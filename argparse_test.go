@@ -2,7 +2,11 @@ package argparse
 
 import (
 	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 func no_exit(exit_status int) {
@@ -10,8 +14,8 @@ func no_exit(exit_status int) {
 }
 
 func TestParse(t *testing.T) {
-	exitFunc = no_exit
 	var parser *ArgumentParser = New("pouet")
+	parser.SetExitFunc(no_exit)
 	parser.Option('b', "by", "By", 1, Store, "", "By")
 	var pargs struct {
 		By string
@@ -47,8 +51,8 @@ func TestParse(t *testing.T) {
 }
 
 func TestAppendConst(t *testing.T) {
-	exitFunc = no_exit
 	var parser *ArgumentParser = New("appendconsttest")
+	parser.SetExitFunc(no_exit)
 
 	parser.Option('a', "aa", "Params", 0, AppendConst("aflag"), "", "Aflag")
 	parser.Option('b', "bb", "Params", 0, AppendConst("bflag"), "", "Bflag")
@@ -96,3 +100,552 @@ func TestAppendConst(t *testing.T) {
 	}
 	pargs.Params = []string{}
 }
+
+func TestCommand(t *testing.T) {
+	var parser *ArgumentParser = New("gitlike")
+	parser.SetExitFunc(no_exit)
+
+	var pargs struct {
+		Remote string
+		Force  bool
+	}
+
+	remoteCmd := parser.Command("remote", "Manage tracked remotes")
+
+	addCmd := remoteCmd.Command("add", "Add a remote")
+	addCmd.Argument("Remote", 1, Store, "NAME", "Remote name")
+	addCmd.Option('f', "force", "Force", 0, StoreConst(true), "", "Overwrite an existing remote")
+
+	ran := false
+	addCmd.Action = func() (err error) {
+		ran = true
+		return nil
+	}
+
+	parse := func(v interface{}, s []string) (err error) {
+		defer func() {
+			if x := recover(); nil != x {
+				err = errors.New("panic caught")
+			}
+		}()
+		return parser.ParseArgs(v, s)
+	}
+
+	err := parse(&pargs, []string{"remote", "add", "origin", "-f"})
+	if nil != err {
+		t.Error("Can not parse cmdline", err)
+	}
+
+	if parser.SelectedCommand() != remoteCmd {
+		t.Error("Wrong selected command on parser")
+	}
+
+	if remoteCmd.SelectedCommand() != addCmd {
+		t.Error("Wrong selected command on remoteCmd")
+	}
+
+	if pargs.Remote != "origin" {
+		t.Error("Wrong value for Remote: ", pargs.Remote)
+	}
+
+	if !pargs.Force {
+		t.Error("Expected Force to be true")
+	}
+
+	if !ran {
+		t.Error("Expected Action to have run")
+	}
+
+	err = parse(&pargs, []string{"bogus"})
+	if nil == err {
+		t.Error("Expected error for unknown command")
+	}
+}
+
+func TestCommandEnforcesParentRequired(t *testing.T) {
+	var parser *ArgumentParser = New("gitlike")
+	parser.SetExitFunc(no_exit)
+
+	parser.Option(0, "config", "Config", 1, Store, "PATH", "Config file to use")
+	parser.OptionalArguments[len(parser.OptionalArguments)-1].Required = true
+
+	deployCmd := parser.Command("deploy", "Deploy the application")
+
+	ran := false
+	deployCmd.Action = func() (err error) {
+		ran = true
+		return nil
+	}
+
+	var pargs struct {
+		Config string
+	}
+
+	parse := func(v interface{}, s []string) (err error) {
+		defer func() {
+			if x := recover(); nil != x {
+				err = errors.New("panic caught")
+			}
+		}()
+		return parser.ParseArgs(v, s)
+	}
+
+	err := parse(&pargs, []string{"deploy"})
+	if nil == err {
+		t.Error("Expected error for missing required option before subcommand dispatch")
+	}
+
+	if ran {
+		t.Error("Expected subcommand Action not to run when a parent required option is missing")
+	}
+}
+
+func TestCommandOnlyRunsLeafAction(t *testing.T) {
+	var parser *ArgumentParser = New("gitlike")
+	parser.SetExitFunc(no_exit)
+
+	var pargs struct {
+		Remote string
+	}
+
+	remoteCmd := parser.Command("remote", "Manage tracked remotes")
+	addCmd := remoteCmd.Command("add", "Add a remote")
+	addCmd.Argument("Remote", 1, Store, "NAME", "Remote name")
+
+	rootRan := false
+	parser.Action = func() (err error) {
+		rootRan = true
+		return nil
+	}
+
+	remoteRan := false
+	remoteCmd.Action = func() (err error) {
+		remoteRan = true
+		return nil
+	}
+
+	addRan := false
+	addCmd.Action = func() (err error) {
+		addRan = true
+		return nil
+	}
+
+	err := parser.ParseArgs(&pargs, []string{"remote", "add", "origin"})
+	if nil != err {
+		t.Error("Can not parse cmdline", err)
+	}
+
+	if !addRan {
+		t.Error("Expected leaf command's Action to have run")
+	}
+
+	if rootRan || remoteRan {
+		t.Error("Expected only the leaf command's Action to run, not its ancestors'")
+	}
+}
+
+func TestNewFromStruct(t *testing.T) {
+	type CommonOpts struct {
+		Verbose bool `short:"v" long:"verbose" help:"Be verbose"`
+	}
+
+	var pargs struct {
+		CommonOpts
+		Name  string   `short:"n" long:"name" default:"anon" help:"Name to use"`
+		Level string   `long:"level" choices:"low,medium,high" help:"Level to use"`
+		Files []string `positional:"true" nargs:"+" metavar:"FILE" help:"Files to process"`
+	}
+
+	parser := NewFromStruct("structtest", &pargs)
+	parser.SetExitFunc(no_exit)
+
+	parse := func(v interface{}, s []string) (err error) {
+		defer func() {
+			if x := recover(); nil != x {
+				err = errors.New("panic caught")
+			}
+		}()
+		return parser.ParseArgs(v, s)
+	}
+
+	err := parse(&pargs, []string{"-v", "--level", "high", "a.txt", "b.txt"})
+	if nil != err {
+		t.Error("Can not parse cmdline", err)
+	}
+
+	if !pargs.Verbose {
+		t.Error("Expected Verbose to be true")
+	}
+
+	if pargs.Name != "anon" {
+		t.Error("Expected default Name, got ", pargs.Name)
+	}
+
+	if pargs.Level != "high" {
+		t.Error("Wrong value for Level: ", pargs.Level)
+	}
+
+	expectedFiles := []string{"a.txt", "b.txt"}
+	if len(expectedFiles) != len(pargs.Files) {
+		t.Error("Wrong number of files: ", pargs.Files)
+	}
+	for i, f := range expectedFiles {
+		if pargs.Files[i] != f {
+			t.Error("Wrong file ", i, ": ", pargs.Files[i])
+		}
+	}
+
+	err = parse(&pargs, []string{"--level", "nope", "a.txt"})
+	if nil == err {
+		t.Error("Expected error for invalid choice")
+	}
+}
+
+func TestConfigFileAndEnv(t *testing.T) {
+	configFile, err := ioutil.TempFile("", "argparse-test-*.ini")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(configFile.Name())
+
+	configFile.WriteString("[defaults]\nhost = config.example.com\n")
+	configFile.Close()
+
+	os.Setenv("ARGPARSE_TEST_PORT", "9090")
+	defer os.Unsetenv("ARGPARSE_TEST_PORT")
+
+	var parser *ArgumentParser = New("configtest")
+	parser.SetExitFunc(no_exit)
+	parser.Option(0, "host", "Host", 1, Store, "HOST", "Host to connect to")
+	parser.Option(0, "port", "Port", 1, Store, "PORT", "Port to connect to")
+	parser.Option(0, "user", "User", 1, Store, "USER", "User to authenticate as")
+
+	for _, optArg := range parser.OptionalArguments {
+		switch optArg.LongName {
+		case "port":
+			optArg.EnvVar = "ARGPARSE_TEST_PORT"
+		case "user":
+			optArg.Required = true
+		}
+	}
+
+	if err := parser.ConfigFile(configFile.Name(), "ini"); nil != err {
+		t.Fatal(err)
+	}
+
+	var pargs struct {
+		Host string
+		Port string
+		User string
+	}
+
+	parse := func(v interface{}, s []string) (err error) {
+		defer func() {
+			if x := recover(); nil != x {
+				err = errors.New("panic caught")
+			}
+		}()
+		return parser.ParseArgs(v, s)
+	}
+
+	err = parse(&pargs, []string{})
+	if nil == err {
+		t.Error("Expected error for missing required option")
+	}
+
+	err = parse(&pargs, []string{"--user", "alice"})
+	if nil != err {
+		t.Error("Can not parse cmdline", err)
+	}
+
+	if pargs.Host != "config.example.com" {
+		t.Error("Wrong value for Host: ", pargs.Host)
+	}
+
+	if pargs.Port != "9090" {
+		t.Error("Wrong value for Port: ", pargs.Port)
+	}
+
+	if pargs.User != "alice" {
+		t.Error("Wrong value for User: ", pargs.User)
+	}
+
+	err = parse(&pargs, []string{"--host", "cli.example.com", "--user", "bob"})
+	if nil != err {
+		t.Error("Can not parse cmdline", err)
+	}
+
+	if pargs.Host != "cli.example.com" {
+		t.Error("CLI value should take precedence, got: ", pargs.Host)
+	}
+}
+
+func TestNewFromStructDefaultDoesNotShadowEnv(t *testing.T) {
+	os.Setenv("ARGPARSE_TEST_NAME", "fromenv")
+	defer os.Unsetenv("ARGPARSE_TEST_NAME")
+
+	var pargs struct {
+		Name string `long:"name" default:"anon" env:"ARGPARSE_TEST_NAME" help:"Name to use"`
+	}
+
+	parser := NewFromStruct("defaulttest", &pargs)
+	parser.SetExitFunc(no_exit)
+
+	if err := parser.ParseArgs(&pargs, []string{}); nil != err {
+		t.Error("Can not parse cmdline", err)
+	}
+
+	if pargs.Name != "fromenv" {
+		t.Error("Expected env var to take precedence over default, got: ", pargs.Name)
+	}
+}
+
+func TestEnvFallbackRespectsAction(t *testing.T) {
+	os.Setenv("ARGPARSE_TEST_LEVEL", "bogus-not-in-choices")
+	defer os.Unsetenv("ARGPARSE_TEST_LEVEL")
+
+	var pargs struct {
+		Level string `long:"level" choices:"low,medium,high" env:"ARGPARSE_TEST_LEVEL" help:"Level to use"`
+	}
+
+	parser := NewFromStruct("levelenvtest", &pargs)
+	parser.SetExitFunc(no_exit)
+
+	if err := parser.ParseArgs(&pargs, []string{}); err == nil {
+		t.Error("Expected error for out-of-choices value sourced from environment")
+	}
+
+	os.Setenv("ARGPARSE_TEST_LEVEL", "medium")
+
+	if err := parser.ParseArgs(&pargs, []string{}); err != nil {
+		t.Error("Can not parse cmdline", err)
+	}
+
+	if pargs.Level != "medium" {
+		t.Error("Wrong value for Level: ", pargs.Level)
+	}
+}
+
+func TestEnvFallbackRespectsUnits(t *testing.T) {
+	os.Setenv("ARGPARSE_TEST_MAXSIZE", "4GiB")
+	defer os.Unsetenv("ARGPARSE_TEST_MAXSIZE")
+
+	var parser *ArgumentParser = New("sizeenvtest")
+	parser.SetExitFunc(no_exit)
+	parser.Option(0, "max-size", "MaxSize", 1, Units(Store, Bytes), "SIZE", "Maximum size")
+
+	for _, optArg := range parser.OptionalArguments {
+		if optArg.LongName == "max-size" {
+			optArg.EnvVar = "ARGPARSE_TEST_MAXSIZE"
+		}
+	}
+
+	var pargs struct {
+		MaxSize int64
+	}
+
+	if err := parser.ParseArgs(&pargs, []string{}); err != nil {
+		t.Error("Can not parse cmdline", err)
+	}
+
+	if pargs.MaxSize != 4*1024*1024*1024 {
+		t.Error("Wrong value for MaxSize: ", pargs.MaxSize)
+	}
+}
+
+func TestConfigFileJSONAndEnvErrors(t *testing.T) {
+	configFile, err := ioutil.TempFile("", "argparse-test-*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(configFile.Name())
+
+	configFile.WriteString(`{"max-size": 4294967296}`)
+	configFile.Close()
+
+	var parser *ArgumentParser = New("jsonconfigtest")
+	parser.SetExitFunc(no_exit)
+	parser.Option(0, "max-size", "MaxSize", 1, Store, "SIZE", "Maximum size")
+
+	if err := parser.ConfigFile(configFile.Name(), "json"); nil != err {
+		t.Fatal(err)
+	}
+
+	var pargs struct {
+		MaxSize int64
+	}
+
+	err = parser.ParseArgs(&pargs, []string{})
+	if nil != err {
+		t.Error("Can not parse cmdline", err)
+	}
+
+	if pargs.MaxSize != 4294967296 {
+		t.Error("Wrong value for MaxSize: ", pargs.MaxSize)
+	}
+
+	badParser := New("badenvtest")
+	badParser.SetExitFunc(no_exit)
+	badParser.Option(0, "count", "Count", 1, Store, "COUNT", "Count to use")
+	badParser.OptionalArguments[len(badParser.OptionalArguments)-1].EnvVar = "ARGPARSE_TEST_BADCOUNT"
+
+	os.Setenv("ARGPARSE_TEST_BADCOUNT", "not-a-number")
+	defer os.Unsetenv("ARGPARSE_TEST_BADCOUNT")
+
+	var badPargs struct {
+		Count int64
+	}
+
+	parse := func(v interface{}, s []string) (err error) {
+		defer func() {
+			if x := recover(); nil != x {
+				err = errors.New("panic caught")
+			}
+		}()
+		return badParser.ParseArgs(v, s)
+	}
+
+	if err := parse(&badPargs, []string{}); err == nil {
+		t.Error("Expected error for malformed environment variable value")
+	}
+}
+
+func TestCompletion(t *testing.T) {
+	var parser *ArgumentParser = New("completiontest")
+	parser.SetExitFunc(no_exit)
+	parser.Option(0, "verbose", "Verbose", 0, StoreConst(true), "", "Be verbose")
+	parser.Argument("Level", 1, Store, "LEVEL", "Level to use")
+	parser.PositionalArguments[0].Choices = []string{"low", "medium", "high"}
+
+	deployCmd := parser.Command("deploy", "Deploy the application")
+	deployCmd.Option('f', "force", "Force", 0, StoreConst(true), "", "Force deploy")
+
+	var buf strings.Builder
+	if err := parser.Completion("bash", &buf); nil != err {
+		t.Error("Can not generate bash completion script", err)
+	}
+	if !strings.Contains(buf.String(), "--complete") {
+		t.Error("Expected bash script to reference --complete")
+	}
+
+	if err := parser.Completion("nosuchshell", &buf); nil == err {
+		t.Error("Expected error for unknown shell")
+	}
+
+	candidates := parser.complete([]string{}, "--verb")
+	if len(candidates) != 1 || candidates[0] != "--verbose" {
+		t.Error("Wrong long option completions: ", candidates)
+	}
+
+	candidates = parser.complete([]string{}, "")
+	found := false
+	for _, c := range candidates {
+		if c == "deploy" {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("Expected deploy command in completions: ", candidates)
+	}
+
+	found = false
+	for _, c := range candidates {
+		if c == "high" {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("Expected positional choice in completions: ", candidates)
+	}
+
+	candidates = parser.complete([]string{"deploy"}, "--f")
+	if len(candidates) != 1 || candidates[0] != "--force" {
+		t.Error("Wrong subcommand completions: ", candidates)
+	}
+}
+
+func TestUnitsAndDuration(t *testing.T) {
+	var parser *ArgumentParser = New("unitstest")
+	parser.SetExitFunc(no_exit)
+	parser.Option(0, "timeout", "Timeout", 1, Duration, "DURATION", "Timeout to use")
+	parser.Option(0, "max-size", "MaxSize", 1, Units(Store, Bytes), "SIZE", "Maximum size")
+	parser.Option(0, "rate", "Rate", 1, Units(Store, SI), "RATE", "Rate limit")
+
+	var pargs struct {
+		Timeout time.Duration
+		MaxSize int64
+		Rate    int64
+	}
+
+	parse := func(v interface{}, s []string) (err error) {
+		defer func() {
+			if x := recover(); nil != x {
+				err = errors.New("panic caught")
+			}
+		}()
+		return parser.ParseArgs(v, s)
+	}
+
+	err := parse(&pargs, []string{"--timeout", "1h30m", "--max-size", "4GiB", "--rate", "10k"})
+	if nil != err {
+		t.Error("Can not parse cmdline", err)
+	}
+
+	if pargs.Timeout != 90*time.Minute {
+		t.Error("Wrong value for Timeout: ", pargs.Timeout)
+	}
+
+	if pargs.MaxSize != 4*1024*1024*1024 {
+		t.Error("Wrong value for MaxSize: ", pargs.MaxSize)
+	}
+
+	if pargs.Rate != 10000 {
+		t.Error("Wrong value for Rate: ", pargs.Rate)
+	}
+
+	err = parse(&pargs, []string{"--max-size", "99999999999999999999GiB"})
+	if nil == err {
+		t.Error("Expected error for overflowing size")
+	}
+}
+
+func TestHelpTemplate(t *testing.T) {
+	var parser *ArgumentParser = New("helptest")
+	parser.SetExitFunc(no_exit)
+	parser.Option('n', "name", "Name", 1, Store, "NAME", "Name to use")
+
+	var buf strings.Builder
+	parser.SetOutput(&buf)
+
+	parser.Help()
+	if !strings.Contains(buf.String(), "--name=NAME") {
+		t.Error("Expected default help to list --name: ", buf.String())
+	}
+
+	buf.Reset()
+	parser.UsageTemplate = "usage: {{.ProgName}} [custom]\n"
+	parser.HelpTemplate = "custom help for {{.ProgName}}"
+	parser.Help()
+
+	if !strings.Contains(buf.String(), "usage: ") || !strings.Contains(buf.String(), "[custom]") {
+		t.Error("Expected custom UsageTemplate to be used: ", buf.String())
+	}
+	if !strings.Contains(buf.String(), "custom help for") {
+		t.Error("Expected custom HelpTemplate to be used: ", buf.String())
+	}
+}
+
+func TestSetOutputAffectsCommandsAddedBeforeIt(t *testing.T) {
+	var parser *ArgumentParser = New("helptest")
+	parser.SetExitFunc(no_exit)
+
+	sub := parser.Command("sub", "A subcommand")
+
+	var buf strings.Builder
+	parser.SetOutput(&buf)
+
+	sub.Help()
+	if buf.String() == "" {
+		t.Error("Expected subcommand declared before SetOutput to still use it")
+	}
+}